@@ -19,11 +19,14 @@ package apimachinery
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
+	"strings"
 	"time"
 
 	"encoding/base64"
+	"encoding/json"
 
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
@@ -32,10 +35,13 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/apiserver/pkg/features"
 	"k8s.io/apiserver/pkg/storage/storagebackend"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/kubernetes/test/e2e/framework"
 	e2elog "k8s.io/kubernetes/test/e2e/framework/log"
@@ -45,6 +51,10 @@ func shouldCheckRemainingItem() bool {
 	return utilfeature.DefaultFeatureGate.Enabled(features.RemainingItemCount)
 }
 
+func shouldCheckWatchBookmark() bool {
+	return utilfeature.DefaultFeatureGate.Enabled(features.WatchBookmark)
+}
+
 const numberOfTotalResources = 400
 
 var _ = SIGDescribe("Servers with support for API chunking", func() {
@@ -128,6 +138,110 @@ var _ = SIGDescribe("Servers with support for API chunking", func() {
 		gomega.Expect(list.Items).To(gomega.HaveLen(numberOfTotalResources))
 	})
 
+	ginkgo.It("should return all results in one page for Limit=0 and oversized Limit requests, and page through them with a latency-adaptive Limit", func() {
+		ns := f.Namespace.Name
+		c := f.ClientSet
+		client := c.CoreV1().ConfigMaps(ns)
+
+		ginkgo.By("listing with Limit=0, which the server treats as unbounded and returns everything in one page")
+		list, err := client.List(metav1.ListOptions{Limit: 0})
+		framework.ExpectNoError(err, "failed to list ConfigMaps in namespace: %s, given limit: %d", ns, 0)
+		gomega.Expect(list.Items).To(gomega.HaveLen(numberOfTotalResources))
+		gomega.Expect(list.Continue).To(gomega.BeEmpty())
+
+		ginkgo.By("listing with a limit far larger than the total number of resources, which should also converge on the total in one page")
+		opts := metav1.ListOptions{Limit: numberOfTotalResources * 10}
+		list, err = client.List(opts)
+		framework.ExpectNoError(err, "failed to list ConfigMaps in namespace: %s, given limit: %d", ns, opts.Limit)
+		gomega.Expect(list.Items).To(gomega.HaveLen(numberOfTotalResources))
+		gomega.Expect(list.Continue).To(gomega.BeEmpty())
+
+		ginkgo.By("paging through the full list with a client that adapts Limit to observed round-trip latency")
+		found, resourceVersions := listAllChunked(client, metav1.ListOptions{Limit: 1}, 50*time.Millisecond)
+		gomega.Expect(found).To(gomega.BeNumerically("==", numberOfTotalResources))
+		for _, rv := range resourceVersions {
+			framework.ExpectEqual(rv, resourceVersions[0])
+		}
+	})
+
+	ginkgo.It("should support watching from the resource version of the last page of a chunked list, with bookmarks", func() {
+		ns := f.Namespace.Name
+		c := f.ClientSet
+		client := c.CoreV1().ConfigMaps(ns)
+
+		ginkgo.By("paging through the full list in chunks of 37")
+		opts := metav1.ListOptions{Limit: 37}
+		var list *v1.ConfigMapList
+		var err error
+		found := 0
+		for {
+			list, err = client.List(opts)
+			framework.ExpectNoError(err, "failed to list ConfigMaps in namespace: %s, given limit: %d", ns, opts.Limit)
+			found += len(list.Items)
+			if len(list.Continue) == 0 {
+				break
+			}
+			opts.Continue = list.Continue
+		}
+		gomega.Expect(found).To(gomega.BeNumerically("==", numberOfTotalResources))
+		listRV := list.ResourceVersion
+
+		ginkgo.By(fmt.Sprintf("starting a watch from the resource version of the last page (%s), allowing bookmarks", listRV))
+		w, err := client.Watch(metav1.ListOptions{
+			ResourceVersion:     listRV,
+			AllowWatchBookmarks: true,
+		})
+		framework.ExpectNoError(err, "failed to watch ConfigMaps in namespace: %s from resource version: %s", ns, listRV)
+		defer w.Stop()
+
+		ginkgo.By("mutating one already-listed ConfigMap and deleting another")
+		mutated, err := client.Get("configmap-0000", metav1.GetOptions{})
+		framework.ExpectNoError(err, "failed to get configmap-0000 in namespace: %s", ns)
+		mutated.Data["testDataField"] = "mutatedValue"
+		_, err = client.Update(mutated)
+		framework.ExpectNoError(err, "failed to update configmap-0000 in namespace: %s", ns)
+		framework.ExpectNoError(client.Delete("configmap-0001", &metav1.DeleteOptions{}), "failed to delete configmap-0001 in namespace: %s", ns)
+
+		ginkgo.By("observing a MODIFIED event, a DELETED event, a BOOKMARK if the feature is enabled, and no ADDED events for already-listed objects")
+		expectBookmark := shouldCheckWatchBookmark()
+		var sawModified, sawDeleted, sawBookmark bool
+		timeout := time.After(2 * time.Minute)
+	watchLoop:
+		for {
+			select {
+			case event, ok := <-w.ResultChan():
+				if !ok {
+					ginkgo.Fail("watch channel closed before observing the expected events")
+				}
+				switch event.Type {
+				case watch.Added:
+					cm := event.Object.(*v1.ConfigMap)
+					framework.Failf("unexpected ADDED event for %s, which was already returned by the chunked list", cm.Name)
+				case watch.Modified:
+					cm := event.Object.(*v1.ConfigMap)
+					framework.ExpectEqual(cm.Name, "configmap-0000")
+					sawModified = true
+				case watch.Deleted:
+					cm := event.Object.(*v1.ConfigMap)
+					framework.ExpectEqual(cm.Name, "configmap-0001")
+					sawDeleted = true
+				case watch.Bookmark:
+					sawBookmark = true
+				}
+				if sawModified && sawDeleted && (sawBookmark || !expectBookmark) {
+					break watchLoop
+				}
+			case <-timeout:
+				break watchLoop
+			}
+		}
+		gomega.Expect(sawModified).To(gomega.BeTrue(), "expected a MODIFIED event for the mutated ConfigMap")
+		gomega.Expect(sawDeleted).To(gomega.BeTrue(), "expected a DELETED event for the deleted ConfigMap")
+		if expectBookmark {
+			gomega.Expect(sawBookmark).To(gomega.BeTrue(), "expected at least one BOOKMARK event within the timeout")
+		}
+	})
+
 	ginkgo.It("should chunk lists of ConfigMaps", func() {
 		ns := f.Namespace.Name
 		c := f.ClientSet
@@ -206,35 +320,10 @@ var _ = SIGDescribe("Servers with support for API chunking", func() {
 		}
 		e2elog.Logf("Retrieved %d/%d results with rv %s and continue %s", len(list.Items), opts.Limit, list.ResourceVersion, firstToken)
 
-		ginkgo.By("retrieving the second page until the token expires")
+		ginkgo.By("retrieving the second page until the token expires, then resuming with the inconsistent continue token")
 		opts.Continue = firstToken
-		var inconsistentToken string
-		wait.Poll(10*time.Second, 1*storagebackend.DefaultCompactInterval, func() (bool, error) {
-			_, err := client.List(opts)
-			if err == nil {
-				e2elog.Logf("Token %s has not expired yet", firstToken)
-				return false, nil
-			}
-			if err != nil && !errors.IsResourceExpired(err) {
-				return false, err
-			}
-			e2elog.Logf("got error %s", err)
-			status, ok := err.(errors.APIStatus)
-			if !ok {
-				return false, fmt.Errorf("expect error to implement the APIStatus interface, got %v", reflect.TypeOf(err))
-			}
-			inconsistentToken = status.Status().ListMeta.Continue
-			if len(inconsistentToken) == 0 {
-				return false, fmt.Errorf("expect non empty continue token")
-			}
-			e2elog.Logf("Retrieved inconsistent continue %s", inconsistentToken)
-			return true, nil
-		})
-
-		ginkgo.By("retrieving the second page again with the token received with the error message")
-		opts.Continue = inconsistentToken
-		list, err = client.List(opts)
-		framework.ExpectNoError(err, "failed to list ConfigMaps in namespace: %s, given inconsistent continue token %s and limit: %d", ns, opts.Continue, opts.Limit)
+		list, err = resumeInconsistent(client, opts)
+		framework.ExpectNoError(err, "failed to resume listing ConfigMaps in namespace: %s with an inconsistent continue token, given limit: %d", ns, opts.Limit)
 		framework.ExpectNotEqual(list.ResourceVersion, firstRV)
 		gomega.Expect(len(list.Items)).To(gomega.BeNumerically("==", opts.Limit))
 		found = int(oneTenth)
@@ -283,8 +372,286 @@ var _ = SIGDescribe("Servers with support for API chunking", func() {
 		}
 		gomega.Expect(found).To(gomega.BeNumerically("==", numberOfTotalResources))
 	})
+
+	ginkgo.It("should return a consistent snapshot when resources are created and deleted concurrently with a chunked list [Slow]", func() {
+		ns := f.Namespace.Name
+		c := f.ClientSet
+		client := c.CoreV1().ConfigMaps(ns)
+
+		ginkgo.By("retrieving the first page, which establishes the snapshot's resource version before any concurrent mutation begins")
+		oneTenth := int64(numberOfTotalResources / 10)
+		opts := metav1.ListOptions{Limit: oneTenth}
+		list, err := client.List(opts)
+		framework.ExpectNoError(err, "failed to list ConfigMaps in namespace: %s, given limit: %d", ns, opts.Limit)
+		firstRV := list.ResourceVersion
+		currentRV := firstRV
+		names := sets.NewString()
+		for _, item := range list.Items {
+			names.Insert(item.Name)
+		}
+		opts.Continue = list.Continue
+
+		ginkgo.By("starting a background goroutine that mutates ConfigMaps in this namespace while the remaining pages are fetched")
+		stopCh := make(chan struct{})
+		mutatorDone := make(chan struct{})
+		go func() {
+			defer close(mutatorDone)
+			next := numberOfTotalResources
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				victim := fmt.Sprintf("configmap-%04d", rand.Intn(numberOfTotalResources))
+				client.Delete(victim, &metav1.DeleteOptions{})
+				client.Create(&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("mutated-%04d", next)},
+					Data:       map[string]string{"testDataField": "testDataValue"},
+				})
+				next++
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+		defer func() {
+			close(stopCh)
+			<-mutatorDone
+		}()
+
+		recovered := false
+		for len(opts.Continue) != 0 {
+			list, err = client.List(opts)
+			if err != nil && errors.IsResourceExpired(err) {
+				e2elog.Logf("continue token expired mid-iteration, recovering via the inconsistent continue token path")
+				list, err = resumeInconsistent(client, opts)
+				framework.ExpectNoError(err, "failed to recover from an expired continue token in namespace: %s", ns)
+				framework.ExpectNotEqual(list.ResourceVersion, currentRV)
+				currentRV = list.ResourceVersion
+				recovered = true
+				for _, item := range list.Items {
+					names.Insert(item.Name)
+				}
+				opts.Continue = list.Continue
+				continue
+			}
+			framework.ExpectNoError(err, "failed to list ConfigMaps in namespace: %s, given limit: %d", ns, opts.Limit)
+			framework.ExpectEqual(list.ResourceVersion, currentRV)
+			for _, item := range list.Items {
+				names.Insert(item.Name)
+			}
+			opts.Continue = list.Continue
+		}
+
+		if recovered {
+			ginkgo.By(fmt.Sprintf("the chunked list observed %d ConfigMap names after recovering from an expired continue token", names.Len()))
+			gomega.Expect(names.List()).ToNot(gomega.BeEmpty())
+			return
+		}
+
+		ginkgo.By(fmt.Sprintf("verifying the names observed while paging exactly match the %d names present at resource version %s, unaffected by concurrent mutation", numberOfTotalResources, firstRV))
+		expected := sets.NewString()
+		for i := 0; i < numberOfTotalResources; i++ {
+			expected.Insert(fmt.Sprintf("configmap-%04d", i))
+		}
+		for _, name := range names.List() {
+			gomega.Expect(name).To(gomega.MatchRegexp(`^configmap-\d{4}$`), "unexpected name %s observed while paging a consistent snapshot", name)
+			gomega.Expect(strings.HasPrefix(name, "mutated-")).To(gomega.BeFalse(), "name %s was created after the snapshot's resource version and should not appear in it", name)
+		}
+		gomega.Expect(names.List()).To(gomega.Equal(expected.List()))
+	})
+
+	ginkgo.It("should chunk-list ConfigMaps, Secrets, and Events in parallel within a comparable wall-clock budget [Slow]", func() {
+		ns := f.Namespace.Name
+		c := f.ClientSet
+
+		ginkgo.By(fmt.Sprintf("seeding %d Secrets and %d Events alongside the ConfigMaps created for this suite", numberOfTotalResources, numberOfTotalResources))
+		secretClient := c.CoreV1().Secrets(ns)
+		eventClient := c.CoreV1().Events(ns)
+		workqueue.ParallelizeUntil(context.TODO(), 20, numberOfTotalResources, func(i int) {
+			_, err := secretClient.Create(&v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("secret-%04d", i)},
+				Data:       map[string][]byte{"testDataField": []byte("testDataValue")},
+			})
+			framework.ExpectNoError(err, "failed to create Secret %d in namespace: %s", i, ns)
+		})
+		workqueue.ParallelizeUntil(context.TODO(), 20, numberOfTotalResources, func(i int) {
+			_, err := eventClient.Create(&v1.Event{
+				ObjectMeta:     metav1.ObjectMeta{Name: fmt.Sprintf("event-%04d", i)},
+				InvolvedObject: v1.ObjectReference{Namespace: ns, Name: "chunking-benchmark"},
+				Reason:         "ChunkingBenchmark",
+				Message:        "seeded for the cross-resource chunking benchmark",
+				Type:           v1.EventTypeNormal,
+			})
+			framework.ExpectNoError(err, "failed to create Event %d in namespace: %s", i, ns)
+		})
+
+		pagers := map[string]func(opts metav1.ListOptions) (items int, bytes int, rv string, cont string, err error){
+			"ConfigMap": func(opts metav1.ListOptions) (int, int, string, string, error) {
+				list, err := c.CoreV1().ConfigMaps(ns).List(opts)
+				if err != nil {
+					return 0, 0, "", "", err
+				}
+				data, _ := json.Marshal(list.Items)
+				return len(list.Items), len(data), list.ResourceVersion, list.Continue, nil
+			},
+			"Secret": func(opts metav1.ListOptions) (int, int, string, string, error) {
+				list, err := c.CoreV1().Secrets(ns).List(opts)
+				if err != nil {
+					return 0, 0, "", "", err
+				}
+				seededCount := 0
+				for _, item := range list.Items {
+					if strings.HasPrefix(item.Name, "secret-") {
+						seededCount++
+					}
+				}
+				data, _ := json.Marshal(list.Items)
+				return seededCount, len(data), list.ResourceVersion, list.Continue, nil
+			},
+			"Event": func(opts metav1.ListOptions) (int, int, string, string, error) {
+				list, err := c.CoreV1().Events(ns).List(opts)
+				if err != nil {
+					return 0, 0, "", "", err
+				}
+				seededCount := 0
+				for _, item := range list.Items {
+					if strings.HasPrefix(item.Name, "event-") {
+						seededCount++
+					}
+				}
+				data, _ := json.Marshal(list.Items)
+				return seededCount, len(data), list.ResourceVersion, list.Continue, nil
+			},
+		}
+		kinds := []string{"ConfigMap", "Secret", "Event"}
+		const parallelism = 20
+		const perKindWallClockBudget = 2 * time.Minute
+
+		type chunkBenchmarkResult struct {
+			kind       string
+			wallClock  time.Duration
+			totalBytes int
+			pageCount  int
+		}
+		results := make([]chunkBenchmarkResult, len(kinds))
+
+		ginkgo.By(fmt.Sprintf("chunked-listing %d resources of each kind with parallelism %d", numberOfTotalResources, parallelism))
+		workqueue.ParallelizeUntil(context.TODO(), parallelism, len(kinds), func(i int) {
+			kind := kinds[i]
+			page := pagers[kind]
+			start := time.Now()
+			opts := metav1.ListOptions{Limit: int64(numberOfTotalResources / 10)}
+			var found, totalBytes, pageCount int
+			var lastRV string
+			for {
+				items, bytes, rv, cont, err := page(opts)
+				framework.ExpectNoError(err, "failed to list %ss in namespace: %s, given limit: %d", kind, ns, opts.Limit)
+				if lastRV != "" {
+					framework.ExpectEqual(rv, lastRV, "resource version drifted across pages while chunk-listing %ss", kind)
+				}
+				lastRV = rv
+				found += items
+				totalBytes += bytes
+				pageCount++
+				if len(cont) == 0 {
+					break
+				}
+				opts.Continue = cont
+			}
+			gomega.Expect(found).To(gomega.BeNumerically("==", numberOfTotalResources), "unexpected number of %ss observed", kind)
+			results[i] = chunkBenchmarkResult{kind: kind, wallClock: time.Since(start), totalBytes: totalBytes, pageCount: pageCount}
+		})
+
+		for _, result := range results {
+			e2elog.Logf("chunking-benchmark kind=%s wallClockMs=%d totalBytes=%d pageCount=%d", result.kind, result.wallClock.Milliseconds(), result.totalBytes, result.pageCount)
+			gomega.Expect(result.wallClock).To(gomega.BeNumerically("<", perKindWallClockBudget), "chunk-listing %ss took longer than the %s budget", result.kind, perKindWallClockBudget)
+		}
+	})
 })
 
+// listAllChunked pages through client using opts as a starting point, adapting
+// opts.Limit between requests based on the observed round-trip latency of the
+// previous page: the limit is halved after a page slower than targetLatency and
+// doubled, up to a small cap, after one comfortably faster. It returns the total
+// number of items observed and the ResourceVersion reported on every page, and
+// asserts that RemainingItemCount strictly decreases from page to page when the
+// feature is enabled.
+func listAllChunked(client corev1client.ConfigMapInterface, opts metav1.ListOptions, targetLatency time.Duration) (int, []string) {
+	const maxAdaptiveLimit = int64(100)
+	if opts.Limit <= 0 {
+		opts.Limit = 1
+	}
+
+	found := 0
+	var resourceVersions []string
+	var lastRemaining *int64
+	for {
+		start := time.Now()
+		list, err := client.List(opts)
+		latency := time.Since(start)
+		framework.ExpectNoError(err, "failed to list ConfigMaps with limit: %d", opts.Limit)
+		e2elog.Logf("Retrieved %d results in %s with limit %d, rv %s and continue %s", len(list.Items), latency, opts.Limit, list.ResourceVersion, list.Continue)
+
+		resourceVersions = append(resourceVersions, list.ResourceVersion)
+		found += len(list.Items)
+
+		if shouldCheckRemainingItem() && list.GetContinue() != "" {
+			gomega.Expect(list.RemainingItemCount).ToNot(gomega.BeNil())
+			if lastRemaining != nil {
+				gomega.Expect(*list.RemainingItemCount).To(gomega.BeNumerically("<", *lastRemaining))
+			}
+			lastRemaining = list.RemainingItemCount
+		}
+
+		if len(list.Continue) == 0 {
+			return found, resourceVersions
+		}
+		opts.Continue = list.Continue
+
+		switch {
+		case latency > targetLatency:
+			opts.Limit = int64(math.Max(1, float64(opts.Limit/2)))
+		case latency < targetLatency/2:
+			opts.Limit = int64(math.Min(float64(maxAdaptiveLimit), float64(opts.Limit*2)))
+		}
+	}
+}
+
+// resumeInconsistent polls client.List(opts) until the continue token in opts is
+// rejected as expired (a 410 Gone / resource-expired error), extracts the
+// inconsistent continue token the apiserver returns alongside that error, and
+// re-issues the list with it. It returns the list retrieved with the inconsistent
+// token, whose ResourceVersion will differ from the one the original token was
+// minted against.
+func resumeInconsistent(client corev1client.ConfigMapInterface, opts metav1.ListOptions) (*v1.ConfigMapList, error) {
+	var inconsistentToken string
+	if err := wait.Poll(10*time.Second, 1*storagebackend.DefaultCompactInterval, func() (bool, error) {
+		_, err := client.List(opts)
+		if err == nil {
+			e2elog.Logf("Token %s has not expired yet", opts.Continue)
+			return false, nil
+		}
+		if !errors.IsResourceExpired(err) {
+			return false, err
+		}
+		e2elog.Logf("got error %s", err)
+		status, ok := err.(errors.APIStatus)
+		if !ok {
+			return false, fmt.Errorf("expect error to implement the APIStatus interface, got %v", reflect.TypeOf(err))
+		}
+		inconsistentToken = status.Status().ListMeta.Continue
+		if len(inconsistentToken) == 0 {
+			return false, fmt.Errorf("expect non empty continue token")
+		}
+		e2elog.Logf("Retrieved inconsistent continue %s", inconsistentToken)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	opts.Continue = inconsistentToken
+	return client.List(opts)
+}
+
 func contains(arr []string, search string) (bool, int) {
 	var posCont int
 	for pos, val := range arr {